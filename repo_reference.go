@@ -5,8 +5,14 @@
 package git
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,6 +22,77 @@ const (
 	RefsTags  = "refs/tags/"
 )
 
+// refNameControlCharRegexp matches ASCII control characters, which are not
+// allowed to appear anywhere in a reference name.
+var refNameControlCharRegexp = regexp.MustCompile(`[\x00-\x1F\x7F]`)
+
+// ErrInvalidRefName is returned when a reference name fails validation
+// against Git's ref-format rules (see git-check-ref-format(1)) before a
+// command is ever executed.
+type ErrInvalidRefName struct {
+	Name   string
+	Reason string
+}
+
+func (err ErrInvalidRefName) Error() string {
+	return fmt.Sprintf("invalid reference name %q: %s", err.Name, err.Reason)
+}
+
+// ValidateReferenceName validates a full reference name (e.g.
+// "refs/heads/master") against the rules enforced by
+// `git check-ref-format`, so that callers get a clean, typed error instead
+// of an opaque failure from the underlying git command.
+func ValidateReferenceName(name string) error {
+	if name == "" {
+		return ErrInvalidRefName{Name: name, Reason: "reference name cannot be empty"}
+	}
+	if name == "@" {
+		return ErrInvalidRefName{Name: name, Reason: `reference name cannot be the single character "@"`}
+	}
+	if strings.Contains(name, "..") {
+		return ErrInvalidRefName{Name: name, Reason: `cannot contain ".."`}
+	}
+	if strings.Contains(name, "@{") {
+		return ErrInvalidRefName{Name: name, Reason: `cannot contain "@{"`}
+	}
+	if refNameControlCharRegexp.MatchString(name) {
+		return ErrInvalidRefName{Name: name, Reason: "cannot contain ASCII control characters"}
+	}
+	if strings.ContainsAny(name, " ~^:?*[\\") {
+		return ErrInvalidRefName{Name: name, Reason: `cannot contain any of " ~^:?*[\\"`}
+	}
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.Contains(name, "//") {
+		return ErrInvalidRefName{Name: name, Reason: "cannot have leading, trailing, or consecutive slashes"}
+	}
+	if strings.HasSuffix(name, ".") {
+		return ErrInvalidRefName{Name: name, Reason: `cannot end with "."`}
+	}
+	if strings.HasSuffix(name, ".lock") {
+		return ErrInvalidRefName{Name: name, Reason: `cannot end with ".lock"`}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") {
+			return ErrInvalidRefName{Name: name, Reason: `no slash-separated component can begin with "."`}
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return ErrInvalidRefName{Name: name, Reason: `no slash-separated component can end with ".lock"`}
+		}
+	}
+	return nil
+}
+
+// ValidateBranchName validates a branch short name (e.g. "master") against
+// the rules enforced by `git check-ref-format`.
+func ValidateBranchName(name string) error {
+	return ValidateReferenceName(RefsHeads + name)
+}
+
+// ValidateTagName validates a tag short name (e.g. "v1.0.0") against the
+// rules enforced by `git check-ref-format`.
+func ValidateTagName(name string) error {
+	return ValidateReferenceName(RefsTags + name)
+}
+
 // RefShortName returns short name of heads or tags. Other references will retrun original string.
 func RefShortName(ref string) string {
 	if strings.HasPrefix(ref, RefsHeads) {
@@ -31,6 +108,20 @@ func RefShortName(ref string) string {
 type Reference struct {
 	ID      string
 	Refspec string
+
+	// Type is the type of object the reference points to, e.g. "commit",
+	// "tag", "blob" or "tree". Only populated by ForEachRef and ForEachRefFunc.
+	Type string
+	// PeeledID is the commit ID an annotated tag points to. Only populated
+	// by ForEachRef and ForEachRefFunc.
+	PeeledID string
+	// Upstream is the remote-tracking ref configured for this reference,
+	// e.g. "refs/remotes/origin/master". Only populated by ForEachRef and
+	// ForEachRefFunc.
+	Upstream string
+	// IsHEAD indicates whether this reference is the current HEAD. Only
+	// populated by ForEachRef and ForEachRefFunc.
+	IsHEAD bool
 }
 
 // ShowRefVerifyOptions contains optional arguments for verifying a reference.
@@ -46,12 +137,19 @@ var ErrReferenceNotExist = errors.New("reference does not exist")
 // ShowRefVerify returns the commit ID of given reference if it exists in the repository
 // in given path.
 func RepoShowRefVerify(repoPath, ref string, opts ...ShowRefVerifyOptions) (string, error) {
+	return RepoShowRefVerifyContext(context.Background(), repoPath, ref, opts...)
+}
+
+// RepoShowRefVerifyContext returns the commit ID of given reference if it exists
+// in the repository in given path. The command is canceled when ctx is done;
+// Timeout in opts is only used as a fallback when ctx has no deadline.
+func RepoShowRefVerifyContext(ctx context.Context, repoPath, ref string, opts ...ShowRefVerifyOptions) (string, error) {
 	var opt ShowRefVerifyOptions
 	if len(opts) > 0 {
 		opt = opts[0]
 	}
 
-	stdout, err := NewCommand("show-ref", "--verify", ref).RunInDirWithTimeout(opt.Timeout, repoPath)
+	stdout, err := NewCommand("show-ref", "--verify", ref).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, repoPath)
 	if err != nil {
 		if strings.Contains(err.Error(), "not a valid ref") {
 			return "", ErrReferenceNotExist
@@ -67,6 +165,13 @@ func (r *Repository) ShowRefVerify(ref string, opts ...ShowRefVerifyOptions) (st
 	return RepoShowRefVerify(r.path, ref, opts...)
 }
 
+// ShowRefVerifyContext returns the commit ID of given reference (e.g.
+// "refs/heads/master") if it exists in the repository. The command is
+// canceled when ctx is done.
+func (r *Repository) ShowRefVerifyContext(ctx context.Context, ref string, opts ...ShowRefVerifyOptions) (string, error) {
+	return RepoShowRefVerifyContext(ctx, r.path, ref, opts...)
+}
+
 // BranchCommitID returns the commit ID of given branch if it exists in the repository.
 // The branch must be given in short name e.g. "master".
 func (r *Repository) BranchCommitID(branch string, opts ...ShowRefVerifyOptions) (string, error) {
@@ -131,6 +236,13 @@ type SymbolicRefOptions struct {
 // SymbolicRef returns the reference name (e.g. "refs/heads/master") pointed by the
 // symbolic ref. It returns an empty string and nil error when doing set operation.
 func (r *Repository) SymbolicRef(opts ...SymbolicRefOptions) (string, error) {
+	return r.SymbolicRefContext(context.Background(), opts...)
+}
+
+// SymbolicRefContext returns the reference name (e.g. "refs/heads/master")
+// pointed by the symbolic ref. It returns an empty string and nil error when
+// doing set operation. The command is canceled when ctx is done.
+func (r *Repository) SymbolicRefContext(ctx context.Context, opts ...SymbolicRefOptions) (string, error) {
 	var opt SymbolicRefOptions
 	if len(opts) > 0 {
 		opt = opts[0]
@@ -142,10 +254,13 @@ func (r *Repository) SymbolicRef(opts ...SymbolicRefOptions) (string, error) {
 	}
 	cmd.AddArgs(opt.Name)
 	if opt.Ref != "" {
+		if err := ValidateReferenceName(opt.Ref); err != nil {
+			return "", err
+		}
 		cmd.AddArgs(opt.Ref)
 	}
 
-	stdout, err := cmd.RunInDirWithTimeout(opt.Timeout, r.path)
+	stdout, err := cmd.RunInDirWithTimeoutAndContext(ctx, opt.Timeout, r.path)
 	if err != nil {
 		return "", err
 	}
@@ -168,6 +283,12 @@ type ShowRefOptions struct {
 
 // ShowRef returns a list of references in the repository.
 func (r *Repository) ShowRef(opts ...ShowRefOptions) ([]*Reference, error) {
+	return r.ShowRefContext(context.Background(), opts...)
+}
+
+// ShowRefContext returns a list of references in the repository. The command
+// is canceled when ctx is done.
+func (r *Repository) ShowRefContext(ctx context.Context, opts ...ShowRefOptions) ([]*Reference, error) {
 	var opt ShowRefOptions
 	if len(opts) > 0 {
 		opt = opts[0]
@@ -185,7 +306,7 @@ func (r *Repository) ShowRef(opts ...ShowRefOptions) ([]*Reference, error) {
 		cmd.AddArgs(opt.Patterns...)
 	}
 
-	stdout, err := cmd.RunInDirWithTimeout(opt.Timeout, r.path)
+	stdout, err := cmd.RunInDirWithTimeoutAndContext(ctx, opt.Timeout, r.path)
 	if err != nil {
 		return nil, err
 	}
@@ -205,25 +326,463 @@ func (r *Repository) ShowRef(opts ...ShowRefOptions) ([]*Reference, error) {
 	return refs, nil
 }
 
+// forEachRefFormat is a NUL-delimited format string for `git for-each-ref`
+// whose fields line up, in order, with the fields populated on Reference by
+// ForEachRef and ForEachRefFunc. It has no trailing %00: for-each-ref already
+// terminates each record with its own "\n", and a trailing %00 would leave
+// that newline glued onto the next record's first field.
+const forEachRefFormat = "%(objectname)%00%(objecttype)%00%(refname)%00%(*objectname)%00%(upstream)%00%(HEAD)"
+
+// forEachRefFields is the number of NUL-delimited fields forEachRefFormat
+// produces per reference.
+const forEachRefFields = 6
+
+// ForEachRefOptions contains optional arguments for streaming references.
+// Docs: https://git-scm.com/docs/git-for-each-ref
+type ForEachRefOptions struct {
+	// Sort determines the field and direction results are sorted by, e.g.
+	// "-creatordate". Passed through to --sort.
+	Sort string
+	// Count limits the number of results returned.
+	Count int
+	// Contains only returns refs which contain the given commit.
+	Contains string
+	// PointsAt only returns refs which point at the given object.
+	PointsAt string
+	// Patterns filters results to refs matching any of the given patterns,
+	// e.g. "refs/heads/*".
+	Patterns []string
+	// Timeout is not read by ForEachRef or ForEachRefFunc: they run the
+	// command through RunInDirPipeline, which takes no timeout argument.
+	Timeout time.Duration
+}
+
+func (opt ForEachRefOptions) apply(cmd *Command) {
+	if opt.Sort != "" {
+		cmd.AddArgs("--sort=" + opt.Sort)
+	}
+	if opt.Count > 0 {
+		cmd.AddArgs(fmt.Sprintf("--count=%d", opt.Count))
+	}
+	if opt.Contains != "" {
+		cmd.AddArgs("--contains", opt.Contains)
+	}
+	if opt.PointsAt != "" {
+		cmd.AddArgs("--points-at", opt.PointsAt)
+	}
+	cmd.AddArgs("--format=" + forEachRefFormat)
+	if len(opt.Patterns) > 0 {
+		cmd.AddArgs("--")
+		cmd.AddArgs(opt.Patterns...)
+	}
+}
+
+// ForEachRefFunc streams references matching opts, invoking fn once per
+// reference, without buffering the entire ref set in memory. Returning a
+// non-nil error from fn stops iteration and that error is returned.
+func (r *Repository) ForEachRefFunc(opts ForEachRefOptions, fn func(*Reference) error) error {
+	cmd := NewCommand("for-each-ref")
+	opts.apply(cmd)
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.RunInDirPipeline(r.path, pw, nil)
+		pw.Close()
+	}()
+
+	// Each for-each-ref record is one "\n"-terminated line; the fields
+	// within a record are NUL-delimited per forEachRefFormat.
+	scanner := bufio.NewScanner(pr)
+
+	var fnErr error
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\x00")
+		if len(fields) != forEachRefFields {
+			continue
+		}
+
+		ref := &Reference{
+			ID:       fields[0],
+			Type:     fields[1],
+			Refspec:  fields[2],
+			PeeledID: fields[3],
+			Upstream: fields[4],
+			IsHEAD:   fields[5] == "*",
+		}
+
+		if fnErr = fn(ref); fnErr != nil {
+			break
+		}
+	}
+
+	pr.CloseWithError(fnErr)
+	if err := <-done; err != nil && fnErr == nil {
+		return err
+	}
+	if fnErr != nil {
+		return fnErr
+	}
+	return scanner.Err()
+}
+
+// ForEachRef returns all references matching opts. For very large ref sets,
+// prefer ForEachRefFunc to avoid buffering every reference in memory.
+func (r *Repository) ForEachRef(opts ForEachRefOptions) ([]*Reference, error) {
+	var refs []*Reference
+	err := r.ForEachRefFunc(opts, func(ref *Reference) error {
+		refs = append(refs, ref)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// Branch represents a Git branch and carries enough context to resolve its
+// commit, upstream and tracking status without the caller re-threading the
+// owning repository through every call.
+type Branch struct {
+	Name    string
+	Refspec string
+
+	gitRepo *Repository
+}
+
 // Branches returns a list of all branches in the repository.
-func (r *Repository) Branches() ([]string, error) {
+func (r *Repository) Branches() ([]*Branch, error) {
 	heads, err := r.ShowRef(ShowRefOptions{Heads: true})
 	if err != nil {
 		return nil, err
 	}
 
-	branches := make([]string, len(heads))
+	branches := make([]*Branch, len(heads))
 	for i := range heads {
-		branches[i] = strings.TrimPrefix(heads[i].Refspec, RefsHeads)
+		branches[i] = &Branch{
+			Name:    strings.TrimPrefix(heads[i].Refspec, RefsHeads),
+			Refspec: heads[i].Refspec,
+			gitRepo: r,
+		}
 	}
 	return branches, nil
 }
 
+// BranchNames returns a list of all branch names in the repository.
+//
+// Deprecated: Use Branches instead.
+func (r *Repository) BranchNames() ([]string, error) {
+	branches, err := r.Branches()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(branches))
+	for i := range branches {
+		names[i] = branches[i].Name
+	}
+	return names, nil
+}
+
+// GetCommit returns the latest commit of the branch.
+func (b *Branch) GetCommit() (*Commit, error) {
+	return b.gitRepo.CatFileCommit(b.Name)
+}
+
+// BranchUpstreamOptions contains optional arguments for resolving a branch's
+// upstream and tracking status.
+type BranchUpstreamOptions struct {
+	// The timeout duration before giving up for each shell command execution.
+	// The default timeout duration will be used when not supplied.
+	Timeout time.Duration
+}
+
+// Upstream returns the remote-tracking branch configured for this branch via
+// `branch.<name>.remote` and `branch.<name>.merge`. It returns a nil Branch
+// and nil error when no upstream is configured.
+func (b *Branch) Upstream(opts ...BranchUpstreamOptions) (*Branch, error) {
+	var opt BranchUpstreamOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	remote, err := NewCommand("config", "--get", "branch."+b.Name+".remote").RunInDirWithTimeout(opt.Timeout, b.gitRepo.path)
+	if err != nil {
+		if err.Error() == "exit status 1" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	merge, err := NewCommand("config", "--get", "branch."+b.Name+".merge").RunInDirWithTimeout(opt.Timeout, b.gitRepo.path)
+	if err != nil {
+		if err.Error() == "exit status 1" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	remoteName := strings.TrimSpace(string(remote))
+	mergeRef := strings.TrimSpace(string(merge))
+	if remoteName == "" || mergeRef == "" {
+		return nil, nil
+	}
+
+	name := remoteName + "/" + RefShortName(mergeRef)
+	return &Branch{
+		Name:    name,
+		Refspec: "refs/remotes/" + name,
+		gitRepo: b.gitRepo,
+	}, nil
+}
+
+// BranchTrackingStatus holds the number of commits a branch is ahead of and
+// behind its upstream.
+type BranchTrackingStatus struct {
+	Ahead  int
+	Behind int
+}
+
+// TrackingStatus returns how far this branch has diverged from its
+// upstream. It returns an error if the branch has no upstream configured.
+func (b *Branch) TrackingStatus(opts ...BranchUpstreamOptions) (*BranchTrackingStatus, error) {
+	var opt BranchUpstreamOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	upstream, err := b.Upstream(opt)
+	if err != nil {
+		return nil, err
+	}
+	if upstream == nil {
+		return nil, fmt.Errorf("branch %q has no upstream", b.Name)
+	}
+
+	stdout, err := NewCommand("rev-list", "--left-right", "--count", b.Name+"..."+upstream.Name).RunInDirWithTimeout(opt.Timeout, b.gitRepo.path)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(stdout))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected output from rev-list: %q", stdout)
+	}
+	ahead, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse ahead count: %v", err)
+	}
+	behind, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("parse behind count: %v", err)
+	}
+	return &BranchTrackingStatus{Ahead: ahead, Behind: behind}, nil
+}
+
+// IsBranchMergedOptions contains optional arguments for checking whether a
+// branch has been merged.
+type IsBranchMergedOptions struct {
+	// The timeout duration before giving up for each shell command execution.
+	// The default timeout duration will be used when not supplied.
+	Timeout time.Duration
+}
+
+// RepoIsBranchMerged reports whether branch has already been merged into
+// into, i.e. whether into's history contains branch's tip commit, in the
+// repository in given path.
+func RepoIsBranchMerged(repoPath, branch, into string, opts ...IsBranchMergedOptions) (bool, error) {
+	return RepoIsBranchMergedContext(context.Background(), repoPath, branch, into, opts...)
+}
+
+// RepoIsBranchMergedContext reports whether branch has already been merged
+// into into in the repository in given path. The command is canceled when
+// ctx is done.
+func RepoIsBranchMergedContext(ctx context.Context, repoPath, branch, into string, opts ...IsBranchMergedOptions) (bool, error) {
+	var opt IsBranchMergedOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	_, err := NewCommand("merge-base", "--is-ancestor", branch, into).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, repoPath)
+	if err != nil {
+		if err.Error() == "exit status 1" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// IsBranchMerged reports whether branch has already been merged into into,
+// i.e. whether into's history contains branch's tip commit.
+func (r *Repository) IsBranchMerged(branch, into string, opts ...IsBranchMergedOptions) (bool, error) {
+	return RepoIsBranchMerged(r.path, branch, into, opts...)
+}
+
+// IsBranchMergedContext reports whether branch has already been merged into
+// into. The command is canceled when ctx is done.
+func (r *Repository) IsBranchMergedContext(ctx context.Context, branch, into string, opts ...IsBranchMergedOptions) (bool, error) {
+	return RepoIsBranchMergedContext(ctx, r.path, branch, into, opts...)
+}
+
+// GetHEADBranch returns the branch pointed to by HEAD. It returns an error
+// when HEAD is detached, i.e. not pointing to a branch.
+func (r *Repository) GetHEADBranch(opts ...SymbolicRefOptions) (*Branch, error) {
+	var opt SymbolicRefOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	opt.Name = "HEAD"
+
+	refspec, err := r.SymbolicRef(opt)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(refspec, RefsHeads) {
+		return nil, fmt.Errorf("HEAD does not point to a branch: %q", refspec)
+	}
+	return &Branch{
+		Name:    strings.TrimPrefix(refspec, RefsHeads),
+		Refspec: refspec,
+		gitRepo: r,
+	}, nil
+}
+
+// CurrentBranchOptions contains optional arguments for getting the current
+// branch.
+type CurrentBranchOptions struct {
+	// The timeout duration before giving up for each shell command execution.
+	// The default timeout duration will be used when not supplied.
+	Timeout time.Duration
+}
+
+// RepoCurrentBranch returns the short name of the branch HEAD points to in
+// the repository in given path, e.g. "master". It returns an empty string
+// and nil error when HEAD is detached.
+func RepoCurrentBranch(repoPath string, opts ...CurrentBranchOptions) (string, error) {
+	return RepoCurrentBranchContext(context.Background(), repoPath, opts...)
+}
+
+// RepoCurrentBranchContext returns the short name of the branch HEAD points
+// to in the repository in given path. The command is canceled when ctx is
+// done.
+func RepoCurrentBranchContext(ctx context.Context, repoPath string, opts ...CurrentBranchOptions) (string, error) {
+	var opt CurrentBranchOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	stdout, err := NewCommand("symbolic-ref", "-q", "--short", "HEAD").RunInDirWithTimeoutAndContext(ctx, opt.Timeout, repoPath)
+	if err != nil {
+		if err.Error() == "exit status 1" {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(stdout)), nil
+}
+
+// CurrentBranch returns the short name of the branch HEAD points to, e.g.
+// "master". It returns an empty string and nil error when HEAD is detached.
+func (r *Repository) CurrentBranch(opts ...CurrentBranchOptions) (string, error) {
+	return RepoCurrentBranch(r.path, opts...)
+}
+
+// CurrentBranchContext returns the short name of the branch HEAD points to.
+// The command is canceled when ctx is done.
+func (r *Repository) CurrentBranchContext(ctx context.Context, opts ...CurrentBranchOptions) (string, error) {
+	return RepoCurrentBranchContext(ctx, r.path, opts...)
+}
+
+// GetDefaultBranch returns the repository's default branch, as recorded by
+// `refs/remotes/origin/HEAD`.
+func (r *Repository) GetDefaultBranch(opts ...SymbolicRefOptions) (*Branch, error) {
+	var opt SymbolicRefOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	opt.Name = "refs/remotes/origin/HEAD"
+
+	refspec, err := r.SymbolicRef(opt)
+	if err != nil {
+		return nil, err
+	}
+	const remoteRefsPrefix = "refs/remotes/"
+	if !strings.HasPrefix(refspec, remoteRefsPrefix+"origin/") {
+		return nil, fmt.Errorf("origin/HEAD does not point to a remote-tracking branch: %q", refspec)
+	}
+	// Name is remote-qualified (e.g. "origin/master"), matching the
+	// convention Upstream uses, since GetCommit resolves commits via Name
+	// rather than Refspec.
+	return &Branch{
+		Name:    strings.TrimPrefix(refspec, remoteRefsPrefix),
+		Refspec: refspec,
+		gitRepo: r,
+	}, nil
+}
+
+// RenameBranchOptions contains optional arguments for renaming a branch.
+type RenameBranchOptions struct {
+	// The timeout duration before giving up for each shell command execution.
+	// The default timeout duration will be used when not supplied.
+	Timeout time.Duration
+}
+
+// RenameBranch renames a branch from one name to another. When force is
+// true, an existing branch named to will be overwritten.
+func (r *Repository) RenameBranch(from, to string, force bool, opts ...RenameBranchOptions) error {
+	if err := ValidateBranchName(to); err != nil {
+		return err
+	}
+
+	var opt RenameBranchOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	cmd := NewCommand("branch")
+	if force {
+		cmd.AddArgs("-M")
+	} else {
+		cmd.AddArgs("-m")
+	}
+	_, err := cmd.AddArgs(from, to).RunInDirWithTimeout(opt.Timeout, r.path)
+	return err
+}
+
+// ErrBranchNotMerged is returned by DeleteBranch when CheckMerged is set and
+// Branch has not yet been merged into Base.
+type ErrBranchNotMerged struct {
+	Branch string
+	Base   string
+}
+
+func (err ErrBranchNotMerged) Error() string {
+	return fmt.Sprintf("branch %q is not merged into %q", err.Branch, err.Base)
+}
+
+// ErrAmbiguousBase is returned by DeleteBranch when CheckMerged is set,
+// Base is empty, and the repository's HEAD is detached, so there is no
+// current branch to default Base to.
+var ErrAmbiguousBase = errors.New("CheckMerged requires an explicit Base when HEAD is detached")
+
 // DeleteBranchOptions contains optional arguments for deleting a branch.
 // // Docs: https://git-scm.com/docs/git-branch
 type DeleteBranchOptions struct {
 	// Indicates whether to force delete the branch.
 	Force bool
+	// When true, refuses to delete the branch unless it has already been
+	// merged into Base, returning a typed ErrBranchNotMerged instead of
+	// relying on git's own stderr-based refusal. Takes effect even when
+	// Force is true.
+	CheckMerged bool
+	// Base is the branch CheckMerged verifies the branch has been merged
+	// into. Defaults to the repository's current branch when empty; if
+	// HEAD is detached and Base is empty, CheckMerged fails with
+	// ErrAmbiguousBase instead of resolving an empty base.
+	Base string
+	// SafetyCheck, when set, is called with the branch name before any
+	// deletion is attempted; a non-nil error aborts the deletion.
+	SafetyCheck func(name string) error
 	// The timeout duration before giving up for each shell command execution.
 	// The default timeout duration will be used when not supplied.
 	Timeout time.Duration
@@ -231,18 +790,56 @@ type DeleteBranchOptions struct {
 
 // RepoDeleteBranch deletes the branch from the repository in given path.
 func RepoDeleteBranch(repoPath, name string, opts ...DeleteBranchOptions) error {
+	return RepoDeleteBranchContext(context.Background(), repoPath, name, opts...)
+}
+
+// RepoDeleteBranchContext deletes the branch from the repository in given
+// path. The command is canceled when ctx is done.
+func RepoDeleteBranchContext(ctx context.Context, repoPath, name string, opts ...DeleteBranchOptions) error {
+	if err := ValidateBranchName(name); err != nil {
+		return err
+	}
+
 	var opt DeleteBranchOptions
 	if len(opts) > 0 {
 		opt = opts[0]
 	}
 
+	if opt.SafetyCheck != nil {
+		if err := opt.SafetyCheck(name); err != nil {
+			return err
+		}
+	}
+
+	if opt.CheckMerged {
+		base := opt.Base
+		if base == "" {
+			var err error
+			base, err = RepoCurrentBranchContext(ctx, repoPath, CurrentBranchOptions{Timeout: opt.Timeout})
+			if err != nil {
+				return err
+			}
+			if base == "" {
+				return ErrAmbiguousBase
+			}
+		}
+
+		merged, err := RepoIsBranchMergedContext(ctx, repoPath, name, base, IsBranchMergedOptions{Timeout: opt.Timeout})
+		if err != nil {
+			return err
+		}
+		if !merged {
+			return ErrBranchNotMerged{Branch: name, Base: base}
+		}
+	}
+
 	cmd := NewCommand("branch")
 	if opt.Force {
 		cmd.AddArgs("-D")
 	} else {
 		cmd.AddArgs("-d")
 	}
-	_, err := cmd.AddArgs(name).RunInDirWithTimeout(opt.Timeout, repoPath)
+	_, err := cmd.AddArgs(name).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, repoPath)
 	return err
 }
 
@@ -251,11 +848,27 @@ func (r *Repository) DeleteBranch(name string, opts ...DeleteBranchOptions) erro
 	return RepoDeleteBranch(r.path, name, opts...)
 }
 
+// DeleteBranchContext deletes the branch from the repository. The command is
+// canceled when ctx is done.
+func (r *Repository) DeleteBranchContext(ctx context.Context, name string, opts ...DeleteBranchOptions) error {
+	return RepoDeleteBranchContext(ctx, r.path, name, opts...)
+}
+
 type CreateBranchOptions struct {
 	Timeout time.Duration
 }
 
 func RepoCreateBranch(repoPath, name string, base string, opts ...CreateBranchOptions) error {
+	return RepoCreateBranchContext(context.Background(), repoPath, name, base, opts...)
+}
+
+// RepoCreateBranchContext creates a branch pointing at base in the
+// repository in given path. The command is canceled when ctx is done.
+func RepoCreateBranchContext(ctx context.Context, repoPath, name string, base string, opts ...CreateBranchOptions) error {
+	if err := ValidateBranchName(name); err != nil {
+		return err
+	}
+
 	var opt CreateBranchOptions
 	if len(opts) > 0 {
 		opt = opts[0]
@@ -263,7 +876,7 @@ func RepoCreateBranch(repoPath, name string, base string, opts ...CreateBranchOp
 
 	cmd := NewCommand("update-ref")
 
-	_, err := cmd.AddArgs(RefsHeads+name).AddArgs(base).RunInDirWithTimeout(opt.Timeout, repoPath)
+	_, err := cmd.AddArgs(RefsHeads+name).AddArgs(base).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, repoPath)
 	return err
 }
 
@@ -271,6 +884,235 @@ func (r *Repository) CreateBranch(name string, base string, opts ...CreateBranch
 	return RepoCreateBranch(r.path, name, base, opts...)
 }
 
+// CreateBranchContext creates a branch pointing at base in the repository.
+// The command is canceled when ctx is done.
+func (r *Repository) CreateBranchContext(ctx context.Context, name string, base string, opts ...CreateBranchOptions) error {
+	return RepoCreateBranchContext(ctx, r.path, name, base, opts...)
+}
+
+// DiffBranchFile describes a single file's change between two branches, as
+// reported by `git diff --raw --numstat`.
+type DiffBranchFile struct {
+	OldPath   string
+	NewPath   string
+	Status    string
+	Additions int
+	Deletions int
+	IsBinary  bool
+	OldMode   string
+	NewMode   string
+	OldSHA    string
+	NewSHA    string
+}
+
+// BranchDiff is the structured result of comparing two branches.
+type BranchDiff struct {
+	Files []*DiffBranchFile
+	// MergeBase is the commit ID of the best common ancestor of the two
+	// branches, as reported by `git merge-base`.
+	MergeBase string
+	// AheadBy is the number of commits b is ahead of the merge base.
+	AheadBy int
+	// BehindBy is the number of commits a is ahead of the merge base, i.e.
+	// how far behind b is.
+	BehindBy int
+}
+
+// DiffBranchesOptions contains optional arguments for comparing two
+// branches.
+type DiffBranchesOptions struct {
+	// TwoDot requests a two-dot (a..b) diff instead of the default
+	// three-dot (a...b) diff against the merge base.
+	TwoDot bool
+	// The timeout duration before giving up for each shell command execution.
+	// The default timeout duration will be used when not supplied.
+	Timeout time.Duration
+}
+
+type diffRawEntry struct {
+	oldMode, newMode, oldSHA, newSHA, status, oldPath, newPath string
+}
+
+type diffNumstatEntry struct {
+	additions, deletions int
+	isBinary             bool
+	oldPath, newPath     string
+}
+
+// splitNULTokens splits NUL-terminated `git diff -z` output into its
+// individual tokens, dropping the trailing empty token left by the final
+// separator.
+func splitNULTokens(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
+	}
+	raw := bytes.Split(data, []byte{0})
+	tokens := make([]string, len(raw))
+	for i := range raw {
+		tokens[i] = string(raw[i])
+	}
+	return tokens
+}
+
+// parseDiffRaw parses the output of `git diff -z --raw`.
+func parseDiffRaw(data []byte) []diffRawEntry {
+	tokens := splitNULTokens(data)
+	var entries []diffRawEntry
+	for i := 0; i < len(tokens); {
+		meta := tokens[i]
+		if !strings.HasPrefix(meta, ":") {
+			i++
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) < 5 {
+			i++
+			continue
+		}
+		i++
+
+		entry := diffRawEntry{
+			oldMode: strings.TrimPrefix(fields[0], ":"),
+			newMode: fields[1],
+			oldSHA:  fields[2],
+			newSHA:  fields[3],
+			status:  fields[4][:1],
+		}
+		if i < len(tokens) {
+			entry.newPath = tokens[i]
+			entry.oldPath = tokens[i]
+			i++
+		}
+		if (entry.status == "R" || entry.status == "C") && i < len(tokens) {
+			entry.oldPath = entry.newPath
+			entry.newPath = tokens[i]
+			i++
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// parseDiffNumstat parses the output of `git diff -z --numstat`.
+func parseDiffNumstat(data []byte) []diffNumstatEntry {
+	tokens := splitNULTokens(data)
+	var entries []diffNumstatEntry
+	for i := 0; i < len(tokens); {
+		fields := strings.SplitN(tokens[i], "\t", 3)
+		i++
+		if len(fields) < 2 {
+			continue
+		}
+
+		var entry diffNumstatEntry
+		if fields[0] == "-" && fields[1] == "-" {
+			entry.isBinary = true
+		} else {
+			entry.additions, _ = strconv.Atoi(fields[0])
+			entry.deletions, _ = strconv.Atoi(fields[1])
+		}
+
+		if len(fields) == 3 && fields[2] != "" {
+			entry.oldPath = fields[2]
+			entry.newPath = fields[2]
+		} else if i+1 < len(tokens) {
+			entry.oldPath = tokens[i]
+			entry.newPath = tokens[i+1]
+			i += 2
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// DiffBranches compares two branches and returns a structured diff,
+// including per-file line counts, rename/copy detection, and the
+// merge-base-relative ahead/behind counts. It parses NUL-delimited
+// `git diff -z` output rather than human-readable stat output, so it handles
+// binary files and paths containing "|" or spaces correctly.
+func (r *Repository) DiffBranches(a, b string, opts ...DiffBranchesOptions) (*BranchDiff, error) {
+	return r.DiffBranchesContext(context.Background(), a, b, opts...)
+}
+
+// DiffBranchesContext compares two branches and returns a structured diff,
+// same as DiffBranches. The commands are canceled when ctx is done.
+func (r *Repository) DiffBranchesContext(ctx context.Context, a, b string, opts ...DiffBranchesOptions) (*BranchDiff, error) {
+	var opt DiffBranchesOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	dots := "..."
+	if opt.TwoDot {
+		dots = ".."
+	}
+	rev := a + dots + b
+
+	rawOut, err := NewCommand("diff", "-z", "--raw", rev).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, r.path)
+	if err != nil {
+		return nil, err
+	}
+	numstatOut, err := NewCommand("diff", "-z", "--numstat", rev).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	numstatByPath := make(map[string]diffNumstatEntry)
+	for _, e := range parseDiffNumstat(numstatOut) {
+		numstatByPath[e.newPath] = e
+	}
+
+	rawEntries := parseDiffRaw(rawOut)
+	files := make([]*DiffBranchFile, 0, len(rawEntries))
+	for _, re := range rawEntries {
+		n := numstatByPath[re.newPath]
+		files = append(files, &DiffBranchFile{
+			OldPath:   re.oldPath,
+			NewPath:   re.newPath,
+			Status:    re.status,
+			Additions: n.additions,
+			Deletions: n.deletions,
+			IsBinary:  n.isBinary,
+			OldMode:   re.oldMode,
+			NewMode:   re.newMode,
+			OldSHA:    re.oldSHA,
+			NewSHA:    re.newSHA,
+		})
+	}
+
+	mergeBaseOut, err := NewCommand("merge-base", a, b).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, r.path)
+	if err != nil {
+		return nil, err
+	}
+	mergeBase := strings.TrimSpace(string(mergeBaseOut))
+
+	aheadOut, err := NewCommand("rev-list", "--count", mergeBase+".."+b).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, r.path)
+	if err != nil {
+		return nil, err
+	}
+	ahead, err := strconv.Atoi(strings.TrimSpace(string(aheadOut)))
+	if err != nil {
+		return nil, fmt.Errorf("parse ahead count: %v", err)
+	}
+
+	behindOut, err := NewCommand("rev-list", "--count", mergeBase+".."+a).RunInDirWithTimeoutAndContext(ctx, opt.Timeout, r.path)
+	if err != nil {
+		return nil, err
+	}
+	behind, err := strconv.Atoi(strings.TrimSpace(string(behindOut)))
+	if err != nil {
+		return nil, fmt.Errorf("parse behind count: %v", err)
+	}
+
+	return &BranchDiff{
+		Files:     files,
+		MergeBase: mergeBase,
+		AheadBy:   ahead,
+		BehindBy:  behind,
+	}, nil
+}
+
 type DiffBranchInfo struct {
 	Repo            string
 	Owner           string
@@ -288,52 +1130,51 @@ type DiffBranchChangeList struct {
 	IsBinary bool
 }
 
+// DiffBranch returns a human-readable summary of the diff between two
+// branches.
+//
+// Deprecated: Use DiffBranches instead, which returns structured per-file
+// results with line counts, modes and object IDs.
 func (repo *Repository) DiffBranch(branch1 string, branch2 string) (diffBranchRes DiffBranchInfo, err error) {
-	data, err := NewCommand("diff", branch1, branch2, "--stat-width=99999").RunInDirBytes(repo.Path())
+	diffBranchRes.Branch1 = branch1
+	diffBranchRes.Branch2 = branch2
+
+	diff, err := repo.DiffBranches(branch1, branch2, DiffBranchesOptions{TwoDot: true})
 	if err != nil {
 		if strings.Contains(err.Error(), "exit status 128") {
 			diffBranchRes.Error = "exit status 128, Repository not exists or branch not exists"
-			return diffBranchRes, err
 		}
 		return diffBranchRes, err
 	}
-	branch1Ref, err := NewCommand("show-ref", "--heads", branch1).RunInDirBytes(repo.Path())
-	if err != nil {
+
+	if branch1CommitId, idErr := repo.BranchCommitID(branch1); idErr == nil {
+		diffBranchRes.Branch1CommitId = branch1CommitId
+	} else {
 		diffBranchRes.Branch1CommitId = branch1
 	}
-	branch1CommitId := strings.Split(string(branch1Ref), " ")[0]
-	diffBranchRes.Branch1CommitId = branch1CommitId
-	branch2Ref, err := NewCommand("show-ref", "--heads", branch2).RunInDirBytes(repo.Path())
-	if err != nil {
+	if branch2CommitId, idErr := repo.BranchCommitID(branch2); idErr == nil {
+		diffBranchRes.Branch2CommitId = branch2CommitId
+	} else {
 		diffBranchRes.Branch2CommitId = branch2
 	}
-	branch2CommitId := strings.Split(string(branch2Ref), " ")[0]
-	diffBranchRes.Branch2CommitId = branch2CommitId
-
-	fileLines := strings.Split(string(data), "\n")
-	isEndReg, _ := regexp.Compile(`\|`)
-	isBinaryReg, _ := regexp.Compile(`\| Bin`)
-	var fileList []DiffBranchChangeList
 
-	for _, v := range fileLines {
-		if isEnd := isEndReg.FindString(v); len(isEnd) == 0 && len(v) > 0 {
-			diffBranchRes.ChangeInfo = strings.Trim(v, " ")
-			break
-		}
-
-		file := strings.Split(v, "|")[0]
-		file = strings.Trim(file, " ")
+	var additions, deletions int
+	fileList := make([]DiffBranchChangeList, 0, len(diff.Files))
+	for _, f := range diff.Files {
+		additions += f.Additions
+		deletions += f.Deletions
 
-		var isBinary bool
-		if isBinaryStr := isBinaryReg.FindString(v); len(isBinaryStr) > 0 && len(v) > 0 {
-			isBinary = true
+		path := f.NewPath
+		if path == "" {
+			path = f.OldPath
 		}
-
 		fileList = append(fileList, DiffBranchChangeList{
-			File:     file,
-			IsBinary: isBinary,
+			File:     path,
+			IsBinary: f.IsBinary,
 		})
 	}
 	diffBranchRes.FileList = fileList
+	diffBranchRes.ChangeInfo = fmt.Sprintf("%d file(s) changed, %d insertion(s)(+), %d deletion(s)(-)", len(diff.Files), additions, deletions)
+
 	return diffBranchRes, nil
 }
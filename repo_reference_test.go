@@ -0,0 +1,95 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import "testing"
+
+func TestValidateReferenceName(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		wantErr bool
+	}{
+		{name: "valid branch ref", ref: "refs/heads/master", wantErr: false},
+		{name: "valid nested ref", ref: "refs/heads/feature/foo", wantErr: false},
+		{name: "empty", ref: "", wantErr: true},
+		{name: "single at sign", ref: "@", wantErr: true},
+		{name: "contains dot dot", ref: "refs/heads/foo..bar", wantErr: true},
+		{name: "contains at brace", ref: "refs/heads/foo@{bar}", wantErr: true},
+		{name: "contains control char", ref: "refs/heads/foo\x01bar", wantErr: true},
+		{name: "contains space", ref: "refs/heads/foo bar", wantErr: true},
+		{name: "contains tilde", ref: "refs/heads/foo~bar", wantErr: true},
+		{name: "contains caret", ref: "refs/heads/foo^bar", wantErr: true},
+		{name: "contains colon", ref: "refs/heads/foo:bar", wantErr: true},
+		{name: "contains question mark", ref: "refs/heads/foo?bar", wantErr: true},
+		{name: "contains asterisk", ref: "refs/heads/foo*bar", wantErr: true},
+		{name: "contains open bracket", ref: "refs/heads/foo[bar", wantErr: true},
+		{name: "contains backslash", ref: `refs/heads/foo\bar`, wantErr: true},
+		{name: "leading slash", ref: "/refs/heads/master", wantErr: true},
+		{name: "trailing slash", ref: "refs/heads/master/", wantErr: true},
+		{name: "consecutive slashes", ref: "refs/heads//master", wantErr: true},
+		{name: "trailing dot", ref: "refs/heads/master.", wantErr: true},
+		{name: "trailing dot lock", ref: "refs/heads/master.lock", wantErr: true},
+		{name: "component starts with dot", ref: "refs/heads/.master", wantErr: true},
+		{name: "component ends with dot lock", ref: "refs/heads/foo.lock/bar", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateReferenceName(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateReferenceName(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			}
+			if err != nil {
+				if _, ok := err.(ErrInvalidRefName); !ok {
+					t.Fatalf("ValidateReferenceName(%q) error type = %T, want ErrInvalidRefName", tt.ref, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateBranchName(t *testing.T) {
+	tests := []struct {
+		name    string
+		branch  string
+		wantErr bool
+	}{
+		{name: "valid", branch: "master", wantErr: false},
+		{name: "valid nested", branch: "feature/foo", wantErr: false},
+		{name: "empty", branch: "", wantErr: true},
+		{name: "contains dot dot", branch: "foo..bar", wantErr: true},
+		{name: "trailing dot lock", branch: "foo.lock", wantErr: true},
+		{name: "leading dot component", branch: ".foo", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateBranchName(tt.branch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateBranchName(%q) error = %v, wantErr %v", tt.branch, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateTagName(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		wantErr bool
+	}{
+		{name: "valid", tag: "v1.0.0", wantErr: false},
+		{name: "empty", tag: "", wantErr: true},
+		{name: "contains caret", tag: "v1^0", wantErr: true},
+		{name: "trailing dot", tag: "v1.0.", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTagName(tt.tag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateTagName(%q) error = %v, wantErr %v", tt.tag, err, tt.wantErr)
+			}
+		})
+	}
+}